@@ -6,16 +6,77 @@ package gin
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 )
 
 const (
 	noWritten     = -1
 	defaultStatus = 200
+
+	// compressMinSize is the smallest body, counted across writes, that
+	// Negotiate will bother compressing; smaller bodies aren't worth the
+	// encoder overhead.
+	compressMinSize = 1024
+)
+
+// compressibleMIMEPrefixes lists the Content-Type prefixes Negotiate
+// considers worth compressing. A response with no Content-Type yet is
+// assumed compressible, since handlers usually set it right before the
+// first Write.
+var compressibleMIMEPrefixes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// writerState tracks the lifecycle of a responseWriter: pending until the
+// header is flushed, committed once WriteHeaderNow has run, and closed once
+// the connection has been taken over (e.g. via Hijack).
+type writerState uint8
+
+const (
+	statePending writerState = iota
+	stateCommitted
+	stateClosed
 )
 
+// ErrAlreadyCommitted is returned by WriteHeaderNow when the response has
+// already been committed, so callers (error-handling middleware, render
+// helpers) can tell a partially-sent response from a fresh one instead of
+// relying on the debug log.
+var ErrAlreadyCommitted = errors.New("gin: response already committed")
+
+// ErrAlreadyCompressing is returned by Hijack when a compression encoder
+// has already started wrapping the underlying connection: taking over the
+// raw connection at that point would leave a partially-encoded stream.
+var ErrAlreadyCompressing = errors.New("gin: cannot hijack a compressing response")
+
+// Encoder streams compressed bytes to an underlying io.Writer. Close must
+// flush and finalize the stream; implementations that also support a
+// mid-stream Flush() error method get it called from responseWriter.Flush.
+type Encoder interface {
+	io.WriteCloser
+}
+
+// EncoderFactory builds an Encoder writing to w. Register one with
+// RegisterEncoder under the token used in Content-Encoding (e.g. "gzip").
+type EncoderFactory func(w io.Writer) Encoder
+
+var encoderRegistry = map[string]EncoderFactory{}
+
+// RegisterEncoder makes a compression encoding available to Negotiate.
+// It's typically called once, from an init function, by the package
+// providing the codec (e.g. a gzip or brotli integration).
+func RegisterEncoder(name string, factory EncoderFactory) {
+	encoderRegistry[name] = factory
+}
+
 // ResponseWriter is used by an Gin HTTP handler to
 // construct an HTTP response.
 type ResponseWriter interface {
@@ -35,33 +96,129 @@ type ResponseWriter interface {
 	Status() int
 
 	// WriteHeaderNow forces to write the http header (status code + headers).
-	WriteHeaderNow()
+	// It is idempotent: calling it again once the response is committed is a
+	// no-op that returns ErrAlreadyCommitted.
+	WriteHeaderNow() error
 
 	// WriteString writes the string into the response body.
 	WriteString(string) (int, error)
 
 	// Written returns true if the response body was already written.
 	Written() bool
+
+	// Committed returns true once the header has been flushed to the
+	// underlying http.ResponseWriter, i.e. after WriteHeaderNow has run.
+	Committed() bool
+
+	// WriteErrorStatus is the fallback-error-page path for error-handling
+	// middleware and render helpers: it consults Committed() before acting,
+	// so a handler that already started streaming a body doesn't get a
+	// corrupted second status line. If the response is already committed,
+	// or body bytes are already buffered behind Negotiate, it gives up
+	// cleanly and returns ErrAlreadyCommitted; otherwise it sets code and
+	// commits the header.
+	WriteErrorStatus(code int) error
+
+	// Before registers a function to be called just before the response is
+	// written to the wire. Handlers/middleware can still mutate the status
+	// code or headers from inside fn, since it runs before WriteHeader is
+	// flushed to the underlying http.ResponseWriter.
+	Before(fn func())
+
+	// After registers a function to be called after the request has been
+	// handled, receiving no arguments. It is meant for logging, metrics
+	// or audit trails that only need to know the response is complete;
+	// use Status()/Size() from within fn to read the final values.
+	After(fn func())
+
+	// Finish marks request dispatch as complete: it commits the header if a
+	// handler never wrote a body, then runs the registered After hooks.
+	// Whoever owns the writer's lifecycle (e.g. the router, at the end of
+	// the middleware chain) must call it exactly once per request; it is
+	// idempotent, and reset also calls it defensively so a pooled writer
+	// never drops hooks from a request that never called it.
+	Finish()
+
+	// Tee registers w as an additional destination for the response body.
+	// Every Write/WriteString is fanned out to w; an error from w never
+	// aborts the primary response, it's simply dropped.
+	Tee(w io.Writer)
+
+	// CaptureBody starts retaining up to limit bytes of the outgoing body,
+	// readable afterwards through Body(). Pass a limit <= 0 to disable
+	// capture and release any buffer already held.
+	CaptureBody(limit int)
+
+	// Body returns the bytes captured so far via CaptureBody, or nil if
+	// capture was never enabled.
+	Body() []byte
+
+	// Negotiate picks the first of encodings registered via RegisterEncoder.
+	// The decision to actually wrap the underlying http.ResponseWriter is
+	// made once Write/WriteString have accumulated compressMinSize bytes
+	// (across calls, not per chunk) or the body ends first, runs after any
+	// Before hooks so they can still correct Content-Type to veto it, and
+	// checks Content-Type/Content-Encoding before wrapping. Once it wraps,
+	// it sets Content-Encoding and Vary: Accept-Encoding and strips
+	// Content-Length.
+	Negotiate(encodings ...string)
+
+	// DeclareTrailer predeclares the HTTP trailer keys that will be sent
+	// after the body, via the Trailer header. It must be called before the
+	// response is committed, and returns ErrAlreadyCommitted otherwise,
+	// consistent with WriteHeaderNow rather than only logging a warning.
+	DeclareTrailer(keys ...string) error
+
+	// AddTrailer sets the value of an HTTP trailer. It may be called at any
+	// point, including after the header has been committed and the body
+	// written, since the key is written with the http.TrailerPrefix
+	// convention that net/http flushes at the end of the response.
+	AddTrailer(key, value string)
 }
 
 type responseWriter struct {
 	http.ResponseWriter
-	size   int
-	status int
+	size        int
+	status      int
+	beforeFuncs []func()
+	afterFuncs  []func()
+	tees        []io.Writer
+	captureLeft int
+	body        []byte
+	state       writerState
+	encoding    string
+	enc         Encoder
+	noCompress  bool
+	pending     []byte
+	beforeRan   bool
+	finished    bool
 }
 
 var _ ResponseWriter = &responseWriter{}
 
 func (w *responseWriter) reset(writer http.ResponseWriter) {
+	w.Finish()
 	w.ResponseWriter = writer
 	w.size = noWritten
 	w.status = defaultStatus
+	w.beforeFuncs = nil
+	w.afterFuncs = nil
+	w.tees = nil
+	w.captureLeft = 0
+	w.body = nil
+	w.state = statePending
+	w.encoding = ""
+	w.enc = nil
+	w.noCompress = false
+	w.pending = nil
+	w.beforeRan = false
+	w.finished = false
 }
 
 // WriteHeader implements the ResponseWriter interface.
 func (w *responseWriter) WriteHeader(code int) {
 	if code > 0 && w.status != code {
-		if w.Written() {
+		if w.Committed() {
 			debugPrint("[WARNING] Headers were already written. Wanted to override status code %d with %d", w.status, code)
 		}
 		w.status = code
@@ -69,29 +226,145 @@ func (w *responseWriter) WriteHeader(code int) {
 }
 
 // WriteHeaderNow implements the ResponseWriter interface.
-func (w *responseWriter) WriteHeaderNow() {
-	if !w.Written() {
+func (w *responseWriter) WriteHeaderNow() error {
+	if w.state != statePending {
+		return ErrAlreadyCommitted
+	}
+	w.runBeforeFuncsOnce()
+	if w.size == noWritten {
 		w.size = 0
-		w.ResponseWriter.WriteHeader(w.status)
+	}
+	w.state = stateCommitted
+	w.ResponseWriter.WriteHeader(w.status)
+	return nil
+}
+
+// runBeforeFuncsOnce runs the registered Before hooks exactly once, however
+// WriteHeaderNow ends up getting called. It must run before anything reads
+// Content-Type to decide on compression (see negotiateEncoding), so a hook
+// that mutates the response late still gets a say.
+func (w *responseWriter) runBeforeFuncsOnce() {
+	if w.beforeRan {
+		return
+	}
+	w.beforeRan = true
+	for _, fn := range w.beforeFuncs {
+		fn()
 	}
 }
 
 // Write implements the ResponseWriter interface.
 func (w *responseWriter) Write(data []byte) (n int, err error) {
-	w.WriteHeaderNow()
-	n, err = w.ResponseWriter.Write(data)
-	w.size += n
-	return
+	return w.writeBody(data)
 }
 
 // WriteString implements the ResponseWriter interface.
 func (w *responseWriter) WriteString(s string) (n int, err error) {
-	w.WriteHeaderNow()
-	n, err = io.WriteString(w.ResponseWriter, s)
+	return w.writeBody([]byte(s))
+}
+
+// writeBody is the shared implementation behind Write and WriteString. When
+// a compression encoding has been negotiated but not yet decided, it holds
+// data back in w.pending until enough has accumulated (across calls) to
+// clear compressMinSize, or until Flush/Finish forces the decision early.
+func (w *responseWriter) writeBody(data []byte) (n int, err error) {
+	w.runBeforeFuncsOnce()
+	if w.encoding != "" && w.enc == nil && !w.noCompress {
+		w.pending = append(w.pending, data...)
+		if w.size == noWritten {
+			w.size = 0
+		}
+		w.size += len(data)
+		w.observe(data)
+		if len(w.pending) < compressMinSize {
+			return len(data), nil
+		}
+		if ferr := w.flushPending(); ferr != nil {
+			return 0, ferr
+		}
+		return len(data), nil
+	}
+	_ = w.WriteHeaderNow()
+	n, err = w.bodyWriter().Write(data)
 	w.size += n
+	w.observe(data[:n])
 	return
 }
 
+// bodyWriter returns the encoder wrapping the response, once negotiated, or
+// the underlying http.ResponseWriter otherwise.
+func (w *responseWriter) bodyWriter() io.Writer {
+	if w.enc != nil {
+		return w.enc
+	}
+	return w.ResponseWriter
+}
+
+// flushPending finalizes the negotiated encoding's compress/no-compress
+// decision for whatever has accumulated in w.pending, commits the header,
+// and sends the buffered bytes. Called once the buffer clears
+// compressMinSize, or from Flush/Finish if the body never did.
+func (w *responseWriter) flushPending() error {
+	w.negotiateEncoding()
+	buf := w.pending
+	w.pending = nil
+	_ = w.WriteHeaderNow()
+	_, err := w.bodyWriter().Write(buf)
+	return err
+}
+
+// negotiateEncoding decides, once, whether the encoding picked by Negotiate
+// actually gets used: it runs after Before hooks (via writeBody/Finish),
+// so a hook that corrects Content-Type can still veto compression, and
+// before the header commits, so Content-Encoding lands in time.
+func (w *responseWriter) negotiateEncoding() {
+	if w.encoding == "" || w.enc != nil || w.noCompress {
+		return
+	}
+	factory, ok := encoderRegistry[w.encoding]
+	if !ok {
+		w.noCompress = true
+		return
+	}
+	if w.Header().Get("Content-Encoding") != "" || !compressibleContentType(w.Header().Get("Content-Type")) {
+		w.noCompress = true
+		return
+	}
+	w.enc = factory(w.ResponseWriter)
+	w.Header().Set("Content-Encoding", w.encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+}
+
+// compressibleContentType reports whether ct matches compressibleMIMEPrefixes.
+func compressibleContentType(ct string) bool {
+	if ct == "" {
+		return true
+	}
+	for _, prefix := range compressibleMIMEPrefixes {
+		if strings.HasPrefix(ct, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe fans data out to any registered tee writers and, while capture is
+// still open, appends it to the retained body buffer. Tee write errors are
+// dropped: a misbehaving observer must never abort the primary response.
+func (w *responseWriter) observe(data []byte) {
+	for _, tee := range w.tees {
+		_, _ = tee.Write(data)
+	}
+	if w.captureLeft > 0 {
+		if len(data) > w.captureLeft {
+			data = data[:w.captureLeft]
+		}
+		w.body = append(w.body, data...)
+		w.captureLeft -= len(data)
+	}
+}
+
 // Status implements the ResponseWriter interface.
 func (w *responseWriter) Status() int {
 	return w.status
@@ -107,11 +380,124 @@ func (w *responseWriter) Written() bool {
 	return w.size != noWritten
 }
 
-// Hijack implements the http.Hijacker interface.
+// Committed implements the ResponseWriter interface.
+func (w *responseWriter) Committed() bool {
+	return w.state != statePending
+}
+
+// WriteErrorStatus implements the ResponseWriter interface.
+func (w *responseWriter) WriteErrorStatus(code int) error {
+	// len(w.pending) > 0 means a body has already started accumulating
+	// behind Negotiate's buffering even though the header hasn't committed
+	// yet (see writeBody): overriding the status now would still flush
+	// those original bytes under the new status line.
+	if w.Committed() || len(w.pending) > 0 {
+		return ErrAlreadyCommitted
+	}
+	w.WriteHeader(code)
+	return w.WriteHeaderNow()
+}
+
+// Before implements the ResponseWriter interface.
+func (w *responseWriter) Before(fn func()) {
+	w.beforeFuncs = append(w.beforeFuncs, fn)
+}
+
+// After implements the ResponseWriter interface.
+func (w *responseWriter) After(fn func()) {
+	w.afterFuncs = append(w.afterFuncs, fn)
+}
+
+// Finish implements the ResponseWriter interface.
+func (w *responseWriter) Finish() {
+	if w.finished {
+		return
+	}
+	w.finished = true
+	if w.ResponseWriter == nil {
+		return
+	}
+	if len(w.pending) > 0 {
+		w.noCompress = true
+		_ = w.flushPending()
+	}
+	if !w.Committed() {
+		_ = w.WriteHeaderNow()
+	}
+	w.runAfterFuncs()
+}
+
+// runAfterFuncs closes a negotiated encoder, if any, then runs the
+// registered after-hooks in registration order. Called from Finish.
+func (w *responseWriter) runAfterFuncs() {
+	if w.enc != nil {
+		_ = w.enc.Close()
+	}
+	for _, fn := range w.afterFuncs {
+		fn()
+	}
+}
+
+// Tee implements the ResponseWriter interface.
+func (w *responseWriter) Tee(writer io.Writer) {
+	w.tees = append(w.tees, writer)
+}
+
+// CaptureBody implements the ResponseWriter interface.
+func (w *responseWriter) CaptureBody(limit int) {
+	if limit <= 0 {
+		w.captureLeft = 0
+		w.body = nil
+		return
+	}
+	w.captureLeft = limit
+	w.body = make([]byte, 0, limit)
+}
+
+// Body implements the ResponseWriter interface.
+func (w *responseWriter) Body() []byte {
+	return w.body
+}
+
+// Negotiate implements the ResponseWriter interface.
+func (w *responseWriter) Negotiate(encodings ...string) {
+	for _, enc := range encodings {
+		if _, ok := encoderRegistry[enc]; ok {
+			w.encoding = enc
+			return
+		}
+	}
+}
+
+// DeclareTrailer implements the ResponseWriter interface.
+func (w *responseWriter) DeclareTrailer(keys ...string) error {
+	if w.Committed() {
+		return ErrAlreadyCommitted
+	}
+	for _, key := range keys {
+		w.Header().Add("Trailer", key)
+	}
+	return nil
+}
+
+// AddTrailer implements the ResponseWriter interface.
+func (w *responseWriter) AddTrailer(key, value string) {
+	w.Header().Set(http.TrailerPrefix+key, value)
+}
+
+// Hijack implements the http.Hijacker interface. Compression must be
+// disabled for the life of the connection once hijacked, since nothing
+// would finalize the encoder's trailing bytes afterwards; wrapping is
+// therefore refused outright.
 func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if w.enc != nil || len(w.pending) > 0 {
+		return nil, nil, ErrAlreadyCompressing
+	}
+	w.encoding = ""
 	if w.size < 0 {
 		w.size = 0
 	}
+	w.state = stateClosed
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
 
@@ -120,12 +506,26 @@ func (w *responseWriter) CloseNotify() <-chan bool {
 	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
 }
 
-// Flush implements the http.Flush interface.
+// Flush implements the http.Flush interface. Any bytes still held back
+// pending a compression decision are sent first (below compressMinSize,
+// so they go out uncompressed), then a negotiated encoder is flushed, so
+// its buffered bytes reach the wire before the underlying
+// http.ResponseWriter is flushed.
 func (w *responseWriter) Flush() {
+	if len(w.pending) > 0 {
+		w.noCompress = true
+		_ = w.flushPending()
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
 	w.ResponseWriter.(http.Flusher).Flush()
 }
 
-// Pusher returns the http.Pusher interface.
+// Pusher returns the http.Pusher interface of the underlying
+// http.ResponseWriter, unchanged. The encoding negotiated for this response
+// does not carry over to pushed resources; nothing here forces identity
+// encoding on them either.
 func (w *responseWriter) Pusher() (pusher http.Pusher, ok bool) {
 	pusher, ok = w.ResponseWriter.(http.Pusher)
 	return
@@ -0,0 +1,256 @@
+// Copyright 2014 Manu Martinez-Almeida.  All rights reserved.
+// Use of this source code is governed by a MIT style
+// license that can be found in the LICENSE file.
+
+package gin
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeEncoder is a pass-through Encoder used to observe whether Negotiate
+// actually wraps the response, without depending on a real codec.
+type fakeEncoder struct {
+	w      io.Writer
+	closed bool
+}
+
+func (e *fakeEncoder) Write(p []byte) (int, error) { return e.w.Write(p) }
+
+func (e *fakeEncoder) Close() error {
+	e.closed = true
+	return nil
+}
+
+func init() {
+	RegisterEncoder("test-enc", func(w io.Writer) Encoder { return &fakeEncoder{w: w} })
+}
+
+func TestResponseWriter_AfterHookFiresOnFinish(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	var fired bool
+	var gotStatus, gotSize int
+	w.After(func() {
+		fired = true
+		gotStatus = w.Status()
+		gotSize = w.Size()
+	})
+
+	w.WriteHeader(201)
+	n, err := w.WriteString("hello")
+	if err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if n != 5 {
+		t.Fatalf("expected 5 bytes written, got %d", n)
+	}
+
+	if fired {
+		t.Fatal("After hook fired before Finish was called")
+	}
+
+	w.Finish()
+
+	if !fired {
+		t.Fatal("After hook never fired after Finish")
+	}
+	if gotStatus != 201 {
+		t.Fatalf("expected status 201 in After hook, got %d", gotStatus)
+	}
+	if gotSize != 5 {
+		t.Fatalf("expected size 5 in After hook, got %d", gotSize)
+	}
+}
+
+func TestResponseWriter_FinishIsIdempotent(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	var calls int
+	w.After(func() { calls++ })
+
+	w.Finish()
+	w.Finish()
+
+	if calls != 1 {
+		t.Fatalf("expected After hook to run once, ran %d times", calls)
+	}
+}
+
+func TestResponseWriter_ResetFlushesPendingHooks(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	var fired bool
+	w.After(func() { fired = true })
+	_, _ = w.WriteString("partial")
+
+	// Simulate pool reuse for a new request without an explicit Finish call.
+	w.reset(httptest.NewRecorder())
+
+	if !fired {
+		t.Fatal("reset dropped a pending After hook without running it")
+	}
+}
+
+func TestResponseWriter_WriteErrorStatusBeforeCommit(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	if err := w.WriteErrorStatus(500); err != nil {
+		t.Fatalf("WriteErrorStatus: %v", err)
+	}
+	if !w.Committed() {
+		t.Fatal("expected response to be committed after WriteErrorStatus")
+	}
+	if rec.Code != 500 {
+		t.Fatalf("expected underlying status 500, got %d", rec.Code)
+	}
+}
+
+func TestResponseWriter_WriteErrorStatusRejectsBufferedCompressionBody(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+	w.Negotiate("test-enc")
+
+	if _, err := w.WriteString("secret-success-data"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if w.Committed() {
+		t.Fatal("expected the response to still be uncommitted while the body is buffered")
+	}
+
+	err := w.WriteErrorStatus(500)
+	if !errors.Is(err, ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted once a body started buffering, got %v", err)
+	}
+
+	w.Finish()
+
+	if rec.Code != 200 {
+		t.Fatalf("expected the original status 200 to be preserved, got %d", rec.Code)
+	}
+	if rec.Body.String() != "secret-success-data" {
+		t.Fatalf("expected the original buffered body to be flushed under its own status, got %q", rec.Body.String())
+	}
+}
+
+func TestResponseWriter_WriteErrorStatusAfterCommit(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	if _, err := w.WriteString("body"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	err := w.WriteErrorStatus(500)
+	if !errors.Is(err, ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+	if rec.Code != 200 {
+		t.Fatalf("expected original status 200 to be preserved, got %d", rec.Code)
+	}
+}
+
+func TestResponseWriter_BeforeHookCanVetoCompression(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+	w.Negotiate("test-enc")
+	w.Before(func() {
+		w.Header().Set("Content-Type", "image/png")
+	})
+
+	body := make([]byte, compressMinSize+10)
+	if _, err := w.Write(body); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.Finish()
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("Before hook set a non-compressible Content-Type, expected compression to be vetoed, got Content-Encoding=%q", enc)
+	}
+}
+
+func TestResponseWriter_CompressionThresholdIsCumulative(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Negotiate("test-enc")
+
+	if _, err := w.WriteString("tiny"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("compression decided too early, on a chunk below compressMinSize: Content-Encoding=%q", enc)
+	}
+
+	rest := make([]byte, compressMinSize)
+	if _, err := w.Write(rest); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "test-enc" {
+		t.Fatalf("expected compression to engage once the cumulative size cleared compressMinSize, got Content-Encoding=%q", enc)
+	}
+}
+
+func TestResponseWriter_ShortBodyFlushesUncompressedOnFinish(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+	w.Header().Set("Content-Type", "text/plain")
+	w.Negotiate("test-enc")
+
+	if _, err := w.WriteString("short"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	w.Finish()
+
+	if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+		t.Fatalf("a body under compressMinSize should never be compressed, got Content-Encoding=%q", enc)
+	}
+	if rec.Body.String() != "short" {
+		t.Fatalf("expected the buffered body to be flushed by Finish, got %q", rec.Body.String())
+	}
+}
+
+func TestResponseWriter_DeclareTrailerBeforeCommit(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	if err := w.DeclareTrailer("Digest"); err != nil {
+		t.Fatalf("DeclareTrailer: %v", err)
+	}
+	if got := rec.Header().Get("Trailer"); got != "Digest" {
+		t.Fatalf("expected Trailer header to be set, got %q", got)
+	}
+}
+
+func TestResponseWriter_DeclareTrailerAfterCommitReturnsError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &responseWriter{}
+	w.reset(rec)
+
+	if _, err := w.WriteString("body"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	err := w.DeclareTrailer("Digest")
+	if !errors.Is(err, ErrAlreadyCommitted) {
+		t.Fatalf("expected ErrAlreadyCommitted, got %v", err)
+	}
+}